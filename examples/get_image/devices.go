@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	aravis "github.com/thinkski/go-aravis"
+)
+
+// managedCamera ties a camera to the imageSource serving it and the
+// cancelFunc that tears its main/sub acquisition pipelines down again.
+type managedCamera struct {
+	deviceId string
+	index    int
+	camera   aravis.Camera
+	is       *imageSource
+	cancel   context.CancelFunc
+}
+
+// cameraManager tracks the set of cameras currently attached, assigns each
+// one a stable index, and dispatches HTTP requests to the right camera. It
+// also implements hot-plug: reconcile() is driven periodically from
+// pollDevices and opens/closes cameras as aravis.UpdateDeviceList reports
+// them appearing or disappearing.
+type cameraManager struct {
+	mu        sync.Mutex
+	byID      map[string]*managedCamera
+	byIndex   map[int]*managedCamera
+	nextIndex int
+
+	ctx context.Context
+	wg  sync.WaitGroup
+}
+
+func newCameraManager(ctx context.Context) *cameraManager {
+	return &cameraManager{
+		byID:    make(map[string]*managedCamera),
+		byIndex: make(map[int]*managedCamera),
+		ctx:     ctx,
+	}
+}
+
+// openCamera opens and starts acquisition for deviceId if it isn't already
+// managed. It is safe to call repeatedly for the same deviceId.
+func (m *cameraManager) openCamera(deviceId string) error {
+	m.mu.Lock()
+	if _, ok := m.byID[deviceId]; ok {
+		m.mu.Unlock()
+		return nil
+	}
+	m.mu.Unlock()
+
+	camera, err := aravis.NewCamera(deviceId)
+	if err != nil {
+		return err
+	}
+
+	mainWidth, mainHeight, mainPayloadSize, err := configureCamera(camera, defaultExposure, defaultGain)
+	if err != nil {
+		camera.Close()
+		return err
+	}
+	subWidth, subHeight, subPayloadSize, err := configureSubStream(camera, mainWidth, mainHeight, subBinning)
+	if err != nil {
+		camera.Close()
+		return err
+	}
+
+	formats := parseFormats(formatsFlag)
+	main, err := newStreamPipeline("main", mainWidth, mainHeight, mainPayloadSize, formats, jpegQuality)
+	if err != nil {
+		camera.Close()
+		return err
+	}
+	sub, err := newStreamPipeline("sub", subWidth, subHeight, subPayloadSize, formats, jpegQuality)
+	if err != nil {
+		camera.Close()
+		return err
+	}
+	if bufferSeconds > 0 {
+		main.ring = newFrameRing(time.Duration(bufferSeconds * float64(time.Second)))
+	}
+	main.cameraID = deviceId
+	sub.cameraID = deviceId
+	exposureMicroseconds.WithLabelValues(deviceId).Set(defaultExposure)
+	gainDecibels.WithLabelValues(deviceId).Set(defaultGain)
+
+	is := &imageSource{
+		camera:   camera,
+		exposure: defaultExposure,
+		gain:     defaultGain,
+		main:     main,
+		sub:      sub,
+	}
+
+	camCtx, cancel := context.WithCancel(m.ctx)
+	mc := &managedCamera{deviceId: deviceId, camera: camera, is: is, cancel: cancel}
+
+	m.mu.Lock()
+	mc.index = m.nextIndex
+	m.nextIndex++
+	m.byID[deviceId] = mc
+	m.byIndex[mc.index] = mc
+	m.mu.Unlock()
+
+	is.activeBackgroundWorkers.Add(1)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer is.activeBackgroundWorkers.Done()
+		runCamera(camCtx, is)
+	}()
+
+	logger.Info("opened camera", "device", deviceId, "index", mc.index)
+	return nil
+}
+
+// stream resolves the "main"/"sub" query value to one of mc's pipelines,
+// defaulting to "main" when name is empty. It returns nil for any other
+// value.
+func (mc *managedCamera) stream(name string) *streamPipeline {
+	switch name {
+	case "", "main":
+		return mc.is.main
+	case "sub":
+		return mc.is.sub
+	default:
+		return nil
+	}
+}
+
+// closeCamera gracefully tears down deviceId: it cancels the acquisition
+// loop, waits for it to drain its buffers and stop, then closes the camera.
+func (m *cameraManager) closeCamera(deviceId string) {
+	m.mu.Lock()
+	mc, ok := m.byID[deviceId]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.byID, deviceId)
+	delete(m.byIndex, mc.index)
+	m.mu.Unlock()
+
+	mc.cancel()
+	mc.is.activeBackgroundWorkers.Wait()
+	mc.camera.Close()
+	logger.Info("closed camera", "device", deviceId, "index", mc.index)
+}
+
+func (m *cameraManager) closeAll() {
+	m.mu.Lock()
+	ids := make([]string, 0, len(m.byID))
+	for id := range m.byID {
+		ids = append(ids, id)
+	}
+	m.mu.Unlock()
+
+	for _, id := range ids {
+		m.closeCamera(id)
+	}
+}
+
+// reconcile re-reads the device list and opens cameras that newly appeared
+// while closing ones that disappeared.
+func (m *cameraManager) reconcile() {
+	aravis.UpdateDeviceList()
+	numDevices, err := aravis.GetNumDevices()
+	if err != nil {
+		logger.Error("reconcile failed", "err", err)
+		return
+	}
+
+	present := make(map[string]bool, numDevices)
+	for i := uint(0); i < numDevices; i++ {
+		id, err := aravis.GetDeviceId(i)
+		if err != nil {
+			continue
+		}
+		present[id] = true
+		if err := m.openCamera(id); err != nil {
+			logger.Error("open camera failed", "device", id, "err", err)
+		}
+	}
+
+	m.mu.Lock()
+	var stale []string
+	for id := range m.byID {
+		if !present[id] {
+			stale = append(stale, id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, id := range stale {
+		m.closeCamera(id)
+	}
+}
+
+func (m *cameraManager) pollDevices(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.reconcile()
+		}
+	}
+}
+
+// lookup finds a managed camera by either its numeric index or its device
+// id, matching the /{index}.png and /{deviceId}.png route forms.
+func (m *cameraManager) lookup(key string) *managedCamera {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if idx, err := strconv.Atoi(key); err == nil {
+		return m.byIndex[idx]
+	}
+	return m.byID[key]
+}
+
+type deviceInfo struct {
+	Index       int     `json:"index"`
+	DeviceId    string  `json:"deviceId"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	PayloadSize uint    `json:"payloadSize"`
+	Exposure    float64 `json:"exposure"`
+	Gain        float64 `json:"gain"`
+	Streaming   bool    `json:"streaming"`
+}
+
+func (mc *managedCamera) info() deviceInfo {
+	mc.is.mu.Lock()
+	defer mc.is.mu.Unlock()
+	return deviceInfo{
+		Index:       mc.index,
+		DeviceId:    mc.deviceId,
+		Width:       mc.is.main.width,
+		Height:      mc.is.main.height,
+		PayloadSize: mc.is.main.payloadSize,
+		Exposure:    mc.is.exposure,
+		Gain:        mc.is.gain,
+		Streaming:   true,
+	}
+}
+
+// streamHealth reports one stream's frame/drop counters and how long ago it
+// last published a frame, so operators can spot a blocked stream.
+type streamHealth struct {
+	Stream              string  `json:"stream"`
+	FrameCount          uint64  `json:"frameCount"`
+	DropCount           uint64  `json:"dropCount"`
+	LastFrameAgeSeconds float64 `json:"lastFrameAgeSeconds"`
+}
+
+func (sp *streamPipeline) health() streamHealth {
+	sp.out.mu.Lock()
+	defer sp.out.mu.Unlock()
+
+	age := -1.0
+	if !sp.out.lastFrame.IsZero() {
+		age = time.Since(sp.out.lastFrame).Seconds()
+	}
+
+	return streamHealth{
+		Stream:              sp.name,
+		FrameCount:          sp.out.frameCount,
+		DropCount:           sp.out.dropCount,
+		LastFrameAgeSeconds: age,
+	}
+}
+
+type cameraHealth struct {
+	Index    int            `json:"index"`
+	DeviceId string         `json:"deviceId"`
+	Streams  []streamHealth `json:"streams"`
+}
+
+func (mc *managedCamera) health() cameraHealth {
+	return cameraHealth{
+		Index:    mc.index,
+		DeviceId: mc.deviceId,
+		Streams:  []streamHealth{mc.is.main.health(), mc.is.sub.health()},
+	}
+}
+
+func (m *cameraManager) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	healths := make([]cameraHealth, 0, len(m.byID))
+	for _, mc := range m.byID {
+		healths = append(healths, mc.health())
+	}
+	m.mu.Unlock()
+
+	sort.Slice(healths, func(i, j int) bool { return healths[i].Index < healths[j].Index })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(healths)
+}
+
+func (m *cameraManager) serveDeviceList(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	infos := make([]deviceInfo, 0, len(m.byID))
+	for _, mc := range m.byID {
+		infos = append(infos, mc.info())
+	}
+	m.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Index < infos[j].Index })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// serveConfig reports mc's current settings on GET, and on POST applies any
+// exposure/gain fields present in a JSON body before reporting them.
+func (m *cameraManager) serveConfig(mc *managedCamera) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var body struct {
+				Exposure *float64 `json:"exposure"`
+				Gain     *float64 `json:"gain"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			mc.is.mu.Lock()
+			if body.Exposure != nil && *body.Exposure != mc.is.exposure {
+				mc.is.camera.SetExposureTime(*body.Exposure)
+				mc.is.exposure = *body.Exposure
+				logger.Info("updated exposure", "camera", mc.deviceId, "exposure", *body.Exposure)
+				exposureMicroseconds.WithLabelValues(mc.deviceId).Set(*body.Exposure)
+			}
+			if body.Gain != nil && *body.Gain != mc.is.gain {
+				mc.is.camera.SetGain(*body.Gain)
+				mc.is.gain = *body.Gain
+				logger.Info("updated gain", "camera", mc.deviceId, "gain", *body.Gain)
+				gainDecibels.WithLabelValues(mc.deviceId).Set(*body.Gain)
+			}
+			mc.is.mu.Unlock()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mc.info())
+	})
+}
+
+// resolve maps a path key to a managed camera and stream. "main"/"sub" are
+// shorthand for that stream on camera index 0; any other key is looked up
+// as an index or device id, with the ?stream= query selecting main or sub
+// (default main).
+func (m *cameraManager) resolve(key string, r *http.Request) (*managedCamera, *streamPipeline) {
+	if key == "main" || key == "sub" {
+		mc := m.lookup("0")
+		if mc == nil {
+			return nil, nil
+		}
+		return mc, mc.stream(key)
+	}
+
+	mc := m.lookup(key)
+	if mc == nil {
+		return nil, nil
+	}
+	return mc, mc.stream(r.FormValue("stream"))
+}
+
+// ServeHTTP dispatches /devices, /healthz, /metrics, /{key}/config,
+// /{key}/snapshot, /{key}/clip, /{key}/trigger, and
+// /{key}.{png,jpeg,raw,mjpeg}, where key is a camera's index or device id,
+// or (for every form but /{key}/config) "main"/"sub" as shorthand for that
+// stream on camera index 0.
+// /snapshot, /clip, and /trigger alone are themselves shorthand for
+// /main/snapshot etc.
+func (m *cameraManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/devices":
+		m.serveDeviceList(w, r)
+		return
+	case "/healthz":
+		m.serveHealthz(w, r)
+		return
+	case "/metrics":
+		promhttp.Handler().ServeHTTP(w, r)
+		return
+	case "/snapshot", "/clip", "/trigger":
+		r.URL.Path = "/main" + r.URL.Path
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+
+	if key := strings.TrimSuffix(path, "/config"); key != path {
+		mc := m.lookup(key)
+		if mc == nil {
+			http.NotFound(w, r)
+			return
+		}
+		m.serveConfig(mc).ServeHTTP(w, r)
+		return
+	}
+
+	for suffix, handler := range map[string]func(*streamPipeline) http.Handler{
+		"/snapshot": serveSnapshot,
+		"/clip":     serveClip,
+	} {
+		key := strings.TrimSuffix(path, suffix)
+		if key == path {
+			continue
+		}
+		mc, sp := m.resolve(key, r)
+		if mc == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if sp == nil {
+			http.Error(w, "unknown stream (want main or sub)", http.StatusBadRequest)
+			return
+		}
+		handler(sp).ServeHTTP(w, r)
+		return
+	}
+
+	if key := strings.TrimSuffix(path, "/trigger"); key != path {
+		mc, sp := m.resolve(key, r)
+		if mc == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if sp == nil {
+			http.Error(w, "unknown stream (want main or sub)", http.StatusBadRequest)
+			return
+		}
+		serveTrigger(sp, triggerSeconds, triggerDir).ServeHTTP(w, r)
+		return
+	}
+
+	for suffix, format := range map[string]string{".png": "png", ".jpeg": "jpeg", ".raw": "raw"} {
+		key := strings.TrimSuffix(path, suffix)
+		if key == path {
+			continue
+		}
+		mc, sp := m.resolve(key, r)
+		if mc == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if sp == nil {
+			http.Error(w, "unknown stream (want main or sub)", http.StatusBadRequest)
+			return
+		}
+		serveImage(mc.is, sp, format).ServeHTTP(w, r)
+		return
+	}
+
+	if key := strings.TrimSuffix(path, ".mjpeg"); key != path {
+		mc, sp := m.resolve(key, r)
+		if mc == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if sp == nil {
+			http.Error(w, "unknown stream (want main or sub)", http.StatusBadRequest)
+			return
+		}
+		serveMJPEG(sp).ServeHTTP(w, r)
+		return
+	}
+
+	http.NotFound(w, r)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// Encoder turns a captured frame into bytes for an HTTP response, returning
+// the content type that should accompany them. captureFrame drives a
+// pipeline's pre-warmed Encoders from its camera's single capture goroutine
+// (runCamera), and per-request encoders are never shared, so
+// implementations don't need to be goroutine-safe, just reusable across
+// frames.
+type Encoder interface {
+	Encode(img *image.Gray, w io.Writer) (contentType string, err error)
+}
+
+// pool lets png.Encoder reuse its EncoderBuffer across frames instead of
+// allocating one per call.
+type pool struct {
+	b *png.EncoderBuffer
+}
+
+func (p *pool) Get() *png.EncoderBuffer { return p.b }
+
+func (p *pool) Put(b *png.EncoderBuffer) { p.b = b }
+
+type pngEncoder struct {
+	enc *png.Encoder
+}
+
+func newPNGEncoder() *pngEncoder {
+	return &pngEncoder{
+		enc: &png.Encoder{
+			CompressionLevel: png.BestSpeed,
+			BufferPool:       &pool{},
+		},
+	}
+}
+
+func (e *pngEncoder) Encode(img *image.Gray, w io.Writer) (string, error) {
+	return "image/png", e.enc.Encode(w, img)
+}
+
+type jpegEncoder struct {
+	quality int
+}
+
+func newJPEGEncoder(quality int) *jpegEncoder {
+	return &jpegEncoder{quality: quality}
+}
+
+func (e *jpegEncoder) Encode(img *image.Gray, w io.Writer) (string, error) {
+	return "image/jpeg", jpeg.Encode(w, img, &jpeg.Options{Quality: e.quality})
+}
+
+// rawEncoder passes the Gray/Bayer pixel buffer through unmodified, for
+// downstream pipelines that want to do their own decoding without paying
+// PNG's CPU cost.
+type rawEncoder struct{}
+
+func (rawEncoder) Encode(img *image.Gray, w io.Writer) (string, error) {
+	_, err := w.Write(img.Pix)
+	return "application/octet-stream", err
+}
+
+// newEncoder constructs the Encoder registered under format. jpegQuality is
+// only consulted for "jpeg" (or its alias "jpg").
+func newEncoder(format string, jpegQuality int) (Encoder, error) {
+	switch format {
+	case "png":
+		return newPNGEncoder(), nil
+	case "jpeg", "jpg":
+		return newJPEGEncoder(jpegQuality), nil
+	case "raw":
+		return rawEncoder{}, nil
+	default:
+		return nil, fmt.Errorf("unknown encoder format %q", format)
+	}
+}
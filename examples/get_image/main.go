@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"context"
 	"flag"
+	"fmt"
 	"image"
-	"image/png"
-	"log"
+	"image/jpeg"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
 	"os"
 	"os/signal"
-	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -18,135 +22,404 @@ import (
 	aravis "github.com/thinkski/go-aravis"
 )
 
-var logger *log.Logger
+var logger *slog.Logger
 
 var defaultExposure float64
 var defaultGain float64
-var mu sync.Mutex
+var formatsFlag string
+var jpegQuality int
+var devicePollInterval time.Duration
+var subBinning int
+var bufferSeconds float64
+var triggerDir string
+var triggerSeconds float64
+var debugLogging bool
+
+// frameBuffer holds the latest encoding for one format, plus the scratch
+// buffer its Encoder writes into before the frame is published.
+type frameBuffer struct {
+	contentType string
+	data        []byte
+	scratch     *bytes.Buffer
+}
 
-// Lock is only needed when swapping buffers
+// mu guards frames, seq and the health counters below. cond is signalled every time
+// frames are updated so subscribers can wake on new frames instead of
+// polling. frameCount/dropCount/lastFrame are this stream's health metrics,
+// surfaced via /healthz so a stalled encoder on one stream doesn't hide
+// behind a healthy sibling.
 type outputBuffer struct {
-	front []byte
-	back *bytes.Buffer
-	mu sync.Mutex
+	mu     sync.Mutex
+	cond   *sync.Cond
+	seq    uint64
+	frames map[string]*frameBuffer
+
+	frameCount uint64
+	dropCount  uint64
+	lastFrame  time.Time
 }
 
-type imageSource struct {
-	camera aravis.Camera
-	mu sync.Mutex
-	exposure float64
-	gain float64
-	width int
-	height int
+// streamPipeline is one independent acquisition pipeline for a camera: its
+// own region, encoders and outputBuffer. A camera time-multiplexes a
+// full-resolution "main" pipeline and a downscaled "sub" pipeline onto its
+// one physical stream and capture goroutine (see runCamera); each still
+// gets its own outputBuffer and health counters, but since they share that
+// one goroutine, a slow pop or encode on either stream stalls the other
+// too.
+type streamPipeline struct {
+	name        string
+	width       int
+	height      int
 	payloadSize uint
-	compression png.CompressionLevel
-	out outputBuffer
-	activeBackgroundWorkers sync.WaitGroup
+	out         outputBuffer
+	encoders    map[string]Encoder
+
+	// buffers are this pipeline's aravis frame buffers. They're allocated
+	// once, the first time the pipeline becomes active, and handed back to
+	// the stream every time runCamera switches back to it.
+	buffers []aravis.Buffer
+
+	// ring is nil unless -buffer-seconds > 0 for this pipeline; only the
+	// main stream gets one.
+	ring *frameRing
+
+	// cameraID labels this pipeline's metrics; it's the owning camera's
+	// device id, shared with its sibling stream.
+	cameraID string
 }
 
-type pool struct {
-	b *png.EncoderBuffer
+type imageSource struct {
+	camera                  aravis.Camera
+	mu                      sync.Mutex
+	serveMu                 sync.Mutex
+	exposure                float64
+	gain                    float64
+	main                    *streamPipeline
+	sub                     *streamPipeline
+	activeBackgroundWorkers sync.WaitGroup
 }
 
-func (p *pool) Get() *png.EncoderBuffer {
-	return p.b
+// configureCamera applies the startup region/exposure/gain/acquisition
+// settings used across every opened camera and reports back the region and
+// payload size the camera settled on.
+func configureCamera(camera aravis.Camera, exposure, gain float64) (width, height int, payloadSize uint, err error) {
+	maxWidth, maxHeight, err := camera.GetSensorSize()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	camera.UVSetUSBMode(aravis.USB_MODE_ASYNC)
+	camera.SetRegion(0, 0, maxWidth, maxHeight)
+	camera.SetExposureTimeAuto(aravis.AUTO_OFF)
+	camera.SetExposureTime(exposure)
+	camera.SetGain(gain)
+	camera.SetFrameRate(0)
+	camera.SetAcquisitionMode(aravis.ACQUISITION_MODE_CONTINUOUS)
+	if payloadSize, err = camera.GetPayloadSize(); err != nil {
+		return 0, 0, 0, err
+	}
+	_, _, width, height, err = camera.GetRegion()
+	return width, height, payloadSize, err
 }
 
-func (p *pool) Put(b *png.EncoderBuffer) {
-	p.b = b
+// configureSubStream briefly switches the camera to a binned region sized
+// as mainWidth/binning x mainHeight/binning to discover the sub-stream's
+// region and payload size, then restores the main region it was called
+// with. There is only one region register on the device, so this is just a
+// startup probe of the sub shape; applyRegion re-applies it for real once
+// runCamera starts time-multiplexing the live capture loop between main and
+// sub.
+func configureSubStream(camera aravis.Camera, mainWidth, mainHeight, binning int) (width, height int, payloadSize uint, err error) {
+	width, height = mainWidth/binning, mainHeight/binning
+	if width <= 0 || height <= 0 {
+		width, height = mainWidth, mainHeight
+	}
+
+	camera.SetRegion(0, 0, width, height)
+	defer camera.SetRegion(0, 0, mainWidth, mainHeight)
+
+	if payloadSize, err = camera.GetPayloadSize(); err != nil {
+		return 0, 0, 0, err
+	}
+	_, _, width, height, err = camera.GetRegion()
+	return width, height, payloadSize, err
 }
 
+// parseFormats splits the -formats flag value, always including "jpeg" and
+// "png" since serveMJPEG (jpeg) and serveTrigger's post-roll (png) read
+// those pre-warmed frames regardless of what the operator asked for.
+func parseFormats(formatsFlag string) []string {
+	formats := strings.Split(formatsFlag, ",")
+	have := map[string]bool{}
+	for _, f := range formats {
+		have[strings.TrimSpace(f)] = true
+	}
+	for _, required := range []string{"jpeg", "png"} {
+		if !have[required] {
+			formats = append(formats, required)
+		}
+	}
+	return formats
+}
 
-func cameraThread(ctx context.Context, is *imageSource) error {
-	// Create a stream
-	stream, err := is.camera.CreateStream()
-	if err != nil {
-		return err
+// newStreamPipeline pre-warms one Encoder per requested format and wires up
+// the outputBuffer they publish into.
+func newStreamPipeline(name string, width, height int, payloadSize uint, formats []string, quality int) (*streamPipeline, error) {
+	sp := &streamPipeline{
+		name:        name,
+		width:       width,
+		height:      height,
+		payloadSize: payloadSize,
 	}
-	defer stream.Close()
 
-	// Add a couple buffers
-	for i := 0; i < 2; i++ {
-		buffer, err := aravis.NewBuffer(is.payloadSize)
+	sp.encoders = make(map[string]Encoder, len(formats))
+	sp.out.frames = make(map[string]*frameBuffer, len(formats))
+	for _, f := range formats {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		enc, err := newEncoder(f, quality)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		stream.PushBuffer(buffer)
+		sp.encoders[f] = enc
+		sp.out.frames[f] = &frameBuffer{scratch: new(bytes.Buffer)}
 	}
+	sp.out.cond = sync.NewCond(&sp.out.mu)
+
+	return sp, nil
+}
+
+// streamBufferCount is how many buffers are kept queued on the stream at
+// once; aravis needs at least one spare to fill while the other is read.
+const streamBufferCount = 2
+
+// subFrameInterval is how often, in frames, the capture loop grabs a frame
+// at sub's binned region instead of main's. The camera only exposes one
+// streaming channel and one region register, so main and sub can't really
+// acquire concurrently; this time-multiplexes the one physical stream
+// between them instead.
+const subFrameInterval = 5
+
+// acquisitionSettleDelay is how long to wait after StartAcquisition before
+// popping frames. USB3 cameras don't deliver their first frame the instant
+// acquisition starts; without this, the first TimeoutPopBuffer after every
+// (re)start — including after each region switch — routinely times out and
+// gets counted as a drop.
+const acquisitionSettleDelay = time.Second
+
+// startAcquisition starts the camera and waits out acquisitionSettleDelay
+// before returning, so callers don't start popping before the device is
+// actually delivering frames.
+func startAcquisition(camera aravis.Camera) {
+	camera.StartAcquisition()
+	time.Sleep(acquisitionSettleDelay)
+}
 
-	encoder := &png.Encoder{
-		png.BestSpeed,
-		&pool{},
+// runCamera opens the camera's one stream and time-multiplexes is.main and
+// is.sub onto it: every subFrameInterval-th frame is captured at sub's
+// binned region, the rest at main's. Switching regions requires
+// acquisition to be paused, so it's stopped and restarted around each
+// switch.
+func runCamera(ctx context.Context, is *imageSource) {
+	stream, err := is.camera.CreateStream()
+	if err != nil {
+		logger.Error("create stream failed", "camera", is.main.cameraID, "err", err)
+		return
 	}
+	defer stream.Close()
 
-	// Start acquisition
-	is.camera.StartAcquisition()
-	defer is.camera.StopAcquisition()
+	current := is.main
+	if err := applyRegion(is.camera, current); err != nil {
+		logger.Error("set region failed", "camera", current.cameraID, "stream", current.name, "err", err)
+		return
+	}
+	fillBuffers(stream, current)
+	defer func() { drainBuffers(stream, current) }()
 
-	time.Sleep(time.Second)
+	startAcquisition(is.camera)
+	defer is.camera.StopAcquisition()
 
-	for {
+	for frameIdx := 0; ; frameIdx++ {
 		select {
 		case <-ctx.Done():
-			return nil
+			return
 		default:
-			//time.Sleep(time.Second * 10)
 		}
 
-		//logger.Print("Start image")
+		want := is.main
+		if frameIdx%subFrameInterval == subFrameInterval-1 {
+			want = is.sub
+		}
 
-		buffer, err := stream.TimeoutPopBuffer(time.Second)
-		if s, _ := buffer.GetStatus(); s != aravis.BUFFER_STATUS_SUCCESS {
-			//logger.Printf("bad buffer: %d, %+v", s, buffer)
-			stream.PushBuffer(buffer)
-			continue
+		if want != current {
+			is.camera.StopAcquisition()
+			drainBuffers(stream, current)
+			if err := applyRegion(is.camera, want); err != nil {
+				logger.Error("switch region failed", "camera", want.cameraID, "from", current.name, "to", want.name, "err", err)
+				applyRegion(is.camera, current)
+			} else {
+				current = want
+			}
+			fillBuffers(stream, current)
+			startAcquisition(is.camera)
+		}
+
+		captureFrame(stream, current)
+	}
+}
+
+// applyRegion sets the camera's region to sp's dimensions and refreshes
+// sp.payloadSize with whatever the device settles on, since some devices
+// round region/binning requests to the nearest size they support.
+func applyRegion(camera aravis.Camera, sp *streamPipeline) error {
+	camera.SetRegion(0, 0, sp.width, sp.height)
+	payloadSize, err := camera.GetPayloadSize()
+	if err != nil {
+		return err
+	}
+	sp.payloadSize = payloadSize
+	return nil
+}
+
+// fillBuffers pushes sp's buffers onto stream, allocating them once the
+// first time sp becomes active. Later switches back to sp reuse the same
+// buffers rather than allocating fresh ones every time, so a long-running
+// process doesn't keep growing its buffer set on every switch.
+func fillBuffers(stream aravis.Stream, sp *streamPipeline) {
+	if sp.buffers == nil {
+		buffers := make([]aravis.Buffer, streamBufferCount)
+		for i := range buffers {
+			buffer, err := aravis.NewBuffer(sp.payloadSize)
+			if err != nil {
+				logger.Error("allocate buffer failed", "camera", sp.cameraID, "stream", sp.name, "err", err)
+				return
+			}
+			buffers[i] = buffer
 		}
-		data, err := buffer.GetData()
+		sp.buffers = buffers
+	}
+	for _, buffer := range sp.buffers {
+		stream.PushBuffer(buffer)
+	}
+}
 
-		img := image.NewGray(
-			image.Rectangle{image.Point{0, 0}, image.Point{is.width, is.height}},
-		)
-		img.Pix = data
+// drainBuffers recovers sp's buffers from stream after StopAcquisition so
+// fillBuffers can hand them straight back out next time sp is active,
+// instead of leaking them or replacing them with fresh allocations.
+func drainBuffers(stream aravis.Stream, sp *streamPipeline) {
+	for i := range sp.buffers {
+		buffer, _ := stream.TimeoutPopBuffer(10 * time.Millisecond)
+		sp.buffers[i] = buffer
+	}
+}
 
-		// Write PNG to outputBuffer
-		err = encoder.Encode(is.out.back, img)
+// captureFrame pops one buffer from stream, runs every pre-warmed encoder
+// for sp over it, and publishes the result. frameCount/dropCount track
+// this pipeline's health independently of whichever other pipeline shares
+// the same physical stream.
+func captureFrame(stream aravis.Stream, sp *streamPipeline) {
+	logger.Debug("start image", "camera", sp.cameraID, "stream", sp.name)
+
+	popStart := time.Now()
+	buffer, _ := stream.TimeoutPopBuffer(time.Second)
+	bufferPopLatencySeconds.WithLabelValues(sp.cameraID, sp.name).Observe(time.Since(popStart).Seconds())
+	if s, _ := buffer.GetStatus(); s != aravis.BUFFER_STATUS_SUCCESS {
+		logger.Debug("bad buffer", "camera", sp.cameraID, "stream", sp.name, "status", s)
+		framesDroppedTotal.WithLabelValues(sp.cameraID, sp.name, strconv.Itoa(int(s))).Inc()
+		stream.PushBuffer(buffer)
+		sp.out.mu.Lock()
+		sp.out.dropCount++
+		sp.out.mu.Unlock()
+		return
+	}
+	data, _ := buffer.GetData()
+
+	// The ring keeps its own copy since data's backing array is owned by
+	// buffer and gets reused once it's pushed back to the stream.
+	var ringPayload []byte
+	if sp.ring != nil {
+		ringPayload = append([]byte(nil), data...)
+	}
+
+	img := image.NewGray(
+		image.Rectangle{image.Point{0, 0}, image.Point{sp.width, sp.height}},
+	)
+	img.Pix = data
+
+	// Run every pre-warmed encoder over this frame before publishing, so a
+	// subscriber on any format always finds an up to date frame waiting
+	// for it rather than paying encode latency per request.
+	encodeFailed := false
+	contentTypes := make(map[string]string, len(sp.out.frames))
+	for format, fb := range sp.out.frames {
+		encodeStart := time.Now()
+		contentType, err := sp.encoders[format].Encode(img, fb.scratch)
 		if err != nil {
-			logger.Println(err)
-			logger.Printf("encode error buffer: %+v", buffer)
-			stream.PushBuffer(buffer)
+			logger.Error("encode failed", "camera", sp.cameraID, "stream", sp.name, "format", format, "err", err)
+			framesDroppedTotal.WithLabelValues(sp.cameraID, sp.name, "encode_error").Inc()
+			fb.scratch.Reset()
+			encodeFailed = true
 			continue
 		}
-		stream.PushBuffer(buffer)
+		encodeDurationSeconds.WithLabelValues(sp.cameraID, sp.name, format).Observe(time.Since(encodeStart).Seconds())
+		encodedFrameBytes.WithLabelValues(sp.cameraID, sp.name, format).Observe(float64(fb.scratch.Len()))
+		contentTypes[format] = contentType
+	}
+	stream.PushBuffer(buffer)
+	if encodeFailed {
+		sp.out.mu.Lock()
+		sp.out.dropCount++
+		sp.out.mu.Unlock()
+		return
+	}
 
-		is.out.mu.Lock()
-		is.out.front = make([]byte, is.out.back.Len())
-		copy(is.out.front, is.out.back.Bytes())
-		is.out.back.Reset()
-		is.out.mu.Unlock()
-		//logger.Print("Stop image")
+	now := time.Now()
+	sp.out.mu.Lock()
+	for format, fb := range sp.out.frames {
+		fb.data = make([]byte, fb.scratch.Len())
+		copy(fb.data, fb.scratch.Bytes())
+		fb.contentType = contentTypes[format]
+		fb.scratch.Reset()
+	}
+	sp.out.seq++
+	sp.out.frameCount++
+	sp.out.lastFrame = now
+	sp.out.cond.Broadcast()
+	sp.out.mu.Unlock()
+
+	framesAcquiredTotal.WithLabelValues(sp.cameraID, sp.name).Inc()
+	if sp.ring != nil {
+		sp.ring.add(now, ringPayload)
 	}
+	logger.Debug("stop image", "camera", sp.cameraID, "stream", sp.name)
 }
 
-func servePNG(is *imageSource) http.Handler {
+// serveImage serves the most recently encoded frame for a format from sp.
+// The format is taken from the ?format= query parameter, falling back to
+// defaultFormat; requesting a format that wasn't pre-warmed via -formats
+// results in a 404.
+func serveImage(is *imageSource, sp *streamPipeline, defaultFormat string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		mu.Lock()
-		defer mu.Unlock()
+		is.serveMu.Lock()
 
 		select {
 		case <-r.Context().Done():
-			logger.Println("request canceled")
+			is.serveMu.Unlock()
+			logger.Debug("request canceled", "camera", sp.cameraID, "stream", sp.name)
 			return
 		default:
 		}
 
-		gainStr := r.FormValue("gain");
+		gainStr := r.FormValue("gain")
 		if gainStr != "" {
 			gain, _ := strconv.ParseFloat(gainStr, 64)
 			if gain != is.gain {
 				is.mu.Lock()
 				is.gain = gain
 				is.camera.SetGain(gain)
-				logger.Printf("Gain: %f", gain)
+				logger.Info("updated gain", "camera", sp.cameraID, "gain", gain)
+				gainDecibels.WithLabelValues(sp.cameraID).Set(gain)
 				is.mu.Unlock()
 			}
 		}
@@ -158,16 +431,113 @@ func servePNG(is *imageSource) http.Handler {
 				is.mu.Lock()
 				is.camera.SetExposureTime(exposure)
 				is.exposure = exposure
-				logger.Printf("Exposure: %f", exposure)
+				logger.Info("updated exposure", "camera", sp.cameraID, "exposure", exposure)
+				exposureMicroseconds.WithLabelValues(sp.cameraID).Set(exposure)
 				is.mu.Unlock()
 			}
 		}
 
-		is.out.mu.Lock()
-		defer is.out.mu.Unlock()
-		_, err := w.Write(is.out.front)
+		format := r.FormValue("format")
+		if format == "" {
+			format = defaultFormat
+		}
+
+		sp.out.mu.Lock()
+		fb, ok := sp.out.frames[format]
+		if !ok {
+			sp.out.mu.Unlock()
+			is.serveMu.Unlock()
+			http.Error(w, fmt.Sprintf("format %q not enabled (see -formats)", format), http.StatusNotFound)
+			return
+		}
+		data := fb.data
+		contentType := fb.contentType
+		sp.out.mu.Unlock()
+		is.serveMu.Unlock()
+
+		w.Header().Set("Content-Type", contentType)
+		n, err := w.Write(data)
+		servedBytesTotal.WithLabelValues(sp.cameraID, sp.name, "image").Add(float64(n))
 		if err != nil {
-			logger.Print(err)
+			logger.Error("write response failed", "camera", sp.cameraID, "stream", sp.name, "err", err)
+		}
+	})
+}
+
+// serveMJPEG streams JPEG frames as they become available as a
+// multipart/x-mixed-replace response, so a browser can display a live view
+// without polling /0.png. An optional ?fps= query parameter caps the
+// emission rate; omitted or <= 0 means send every frame as it arrives.
+func serveMJPEG(sp *streamPipeline) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fps, _ := strconv.ParseFloat(r.FormValue("fps"), 64)
+		var minInterval time.Duration
+		if fps > 0 {
+			minInterval = time.Duration(float64(time.Second) / fps)
+		}
+
+		mw := multipart.NewWriter(w)
+		defer mw.Close()
+		w.Header().Set("Content-Type", fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", mw.Boundary()))
+		w.WriteHeader(http.StatusOK)
+
+		ctx := r.Context()
+
+		// sync.Cond has no context-aware wait, so wake the waiter on
+		// cancellation by broadcasting from a watcher goroutine.
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				sp.out.mu.Lock()
+				sp.out.cond.Broadcast()
+				sp.out.mu.Unlock()
+			case <-done:
+			}
+		}()
+
+		sp.out.mu.Lock()
+		lastSeq := sp.out.seq
+		sp.out.mu.Unlock()
+
+		var lastSent time.Time
+		for {
+			sp.out.mu.Lock()
+			for sp.out.seq == lastSeq && ctx.Err() == nil {
+				sp.out.cond.Wait()
+			}
+			if ctx.Err() != nil {
+				sp.out.mu.Unlock()
+				logger.Debug("mjpeg client canceled", "camera", sp.cameraID, "stream", sp.name)
+				return
+			}
+			lastSeq = sp.out.seq
+			frame := sp.out.frames["jpeg"].data
+			sp.out.mu.Unlock()
+
+			if minInterval > 0 {
+				if wait := minInterval - time.Since(lastSent); wait > 0 {
+					time.Sleep(wait)
+				}
+				lastSent = time.Now()
+			}
+
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":   {"image/jpeg"},
+				"Content-Length": {strconv.Itoa(len(frame))},
+			})
+			if err != nil {
+				return
+			}
+			n, err := part.Write(frame)
+			servedBytesTotal.WithLabelValues(sp.cameraID, sp.name, "mjpeg").Add(float64(n))
+			if err != nil {
+				return
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
 		}
 	})
 }
@@ -175,89 +545,83 @@ func servePNG(is *imageSource) http.Handler {
 func init() {
 	flag.Float64Var(&defaultExposure, "e", 103656.0, "Exposure time (in us)")
 	flag.Float64Var(&defaultGain, "g", 10.00000015, "Gain (in dB)")
+	flag.StringVar(&formatsFlag, "formats", "png,jpeg", "Comma-separated list of encoders to pre-warm (png, jpeg, raw)")
+	flag.IntVar(&jpegQuality, "quality", jpeg.DefaultQuality, "JPEG encoder quality (1-100)")
+	flag.DurationVar(&devicePollInterval, "poll-interval", 5*time.Second, "How often to rescan for attached/removed cameras")
+	flag.IntVar(&subBinning, "sub-binning", 2, "Downscale factor for the sub stream relative to the main stream")
+	flag.Float64Var(&bufferSeconds, "buffer-seconds", 0, "Seconds of main-stream frames to keep buffered for /snapshot and /clip (0 disables the ring buffer)")
+	flag.StringVar(&triggerDir, "trigger-dir", "clips", "Directory /trigger writes pre/post-roll frames under")
+	flag.Float64Var(&triggerSeconds, "trigger-seconds", 5.0, "Default post-roll duration (in seconds) for /trigger")
+	flag.BoolVar(&debugLogging, "debug", false, "Log per-frame acquire/encode events at DEBUG")
 }
 
 func main() {
-	logger = log.Default()
-	logger.SetFlags(log.Ltime |	log.Lmicroseconds)
 	var err error
 	var numDevices uint
 
 	flag.Parse()
 
+	logLevel := slog.LevelInfo
+	if debugLogging {
+		logLevel = slog.LevelDebug
+	}
+	logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
 	// Get devices
 	aravis.UpdateDeviceList()
 	if numDevices, err = aravis.GetNumDevices(); err != nil {
-		logger.Fatal(err)
+		logger.Error("get num devices", "err", err)
+		os.Exit(1)
 	}
-
-	// Must find at least one device
 	if numDevices == 0 {
-		logger.Fatal("No devices found. Exiting.")
-		return
+		logger.Info("no devices found at startup; waiting for hot-plug")
 	}
 
-	name, _ := aravis.GetDeviceId(0)
-	camera, _ := aravis.NewCamera(name)
-	defer camera.Close()
-
-	maxWidth, maxHeight, _ := camera.GetSensorSize()
-	camera.UVSetUSBMode(aravis.USB_MODE_ASYNC)
-	camera.SetRegion(0, 0, maxWidth, maxHeight)
-	camera.SetExposureTimeAuto(aravis.AUTO_OFF)
-	camera.SetExposureTime(defaultExposure)
-	camera.SetGain(defaultGain)
-	camera.SetFrameRate(0)
-	camera.SetAcquisitionMode(aravis.ACQUISITION_MODE_CONTINUOUS)
-	size, _ := camera.GetPayloadSize()
-	_, _, width, height, _ := camera.GetRegion()
-
-
-	logger.Printf("Found camera: %s Exposure: %f, Gain: %f", name, defaultExposure, defaultGain)
+	ctx, cancelFunc := context.WithCancel(context.Background())
 
-	is := imageSource{
-		camera: camera,
-		exposure: defaultExposure,
-		gain: defaultGain,
-		width: width,
-		height: height,
-		payloadSize: size,
-		compression: png.BestSpeed,
+	manager := newCameraManager(ctx)
+	for i := uint(0); i < numDevices; i++ {
+		name, err := aravis.GetDeviceId(i)
+		if err != nil {
+			logger.Error("get device id failed", "index", i, "err", err)
+			continue
+		}
+		if err := manager.openCamera(name); err != nil {
+			logger.Error("open camera failed", "device", name, "err", err)
+		}
 	}
 
-	is.out.back = new(bytes.Buffer)
-
-	ctx, cancelFunc := context.WithCancel(context.Background())
-
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
-	mux := http.NewServeMux()
-	mux.Handle("/0.png", servePNG(&is))
 	webServer := &http.Server{
-		Addr: ":8000",
-		Handler: mux,
+		Addr:    ":8000",
+		Handler: manager,
 	}
-	
-	is.activeBackgroundWorkers.Add(2)
+
+	var backgroundWorkers sync.WaitGroup
+	backgroundWorkers.Add(2)
 	go func() {
-		defer is.activeBackgroundWorkers.Done()
-		cameraThread(ctx, &is)
+		defer backgroundWorkers.Done()
+		manager.pollDevices(ctx, devicePollInterval)
 	}()
 	go func() {
-		defer is.activeBackgroundWorkers.Done()
-		logger.Print("Listening...")
-		logger.Print(webServer.ListenAndServe())
+		defer backgroundWorkers.Done()
+		logger.Info("listening", "addr", webServer.Addr)
+		if err := webServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("server exited", "err", err)
+		}
 	}()
 
 	select {
 	case sig := <-signalChan:
-        logger.Printf("Recieved signal: %s", sig)
+		logger.Info("received signal", "signal", sig.String())
 	}
 
 	cancelFunc()
-	ctx, _ = context.WithTimeout(context.Background(), time.Duration(time.Second * 5))
-	webServer.Shutdown(ctx)
-	is.activeBackgroundWorkers.Wait()
-	logger.Print("Quitting.")
+	shutdownCtx, _ := context.WithTimeout(context.Background(), time.Duration(time.Second*5))
+	webServer.Shutdown(shutdownCtx)
+	manager.closeAll()
+	backgroundWorkers.Wait()
+	logger.Info("quitting")
 }
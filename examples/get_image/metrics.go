@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// These are registered against the default Prometheus registry and served
+// at /metrics by promhttp.Handler() in devices.go. Every metric is labeled
+// by camera (the device id), and all but the exposure/gain gauges also by
+// stream ("main" or "sub") so a stalled sub
+// stream's counters don't hide behind a healthy main stream's, matching the
+// per-pipeline health tracking in outputBuffer — main and sub still share
+// one capture goroutine and physical stream (see runCamera), so a stall on
+// either eventually shows up in both.
+var (
+	framesAcquiredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aravis_frames_acquired_total",
+		Help: "Frames successfully popped, encoded and published.",
+	}, []string{"camera", "stream"})
+
+	framesDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aravis_frames_dropped_total",
+		Help: "Frames dropped, labeled by the aravis buffer status code (see GetStatus) or \"encode_error\".",
+	}, []string{"camera", "stream", "reason"})
+
+	bufferPopLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aravis_buffer_pop_latency_seconds",
+		Help:    "Time spent in TimeoutPopBuffer waiting for the next frame.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"camera", "stream"})
+
+	encodeDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aravis_encode_duration_seconds",
+		Help:    "Time spent encoding one frame for one format.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"camera", "stream", "format"})
+
+	encodedFrameBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aravis_encoded_frame_bytes",
+		Help:    "Size of one encoded frame.",
+		Buckets: prometheus.ExponentialBuckets(1024, 2, 12),
+	}, []string{"camera", "stream", "format"})
+
+	servedBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aravis_served_bytes_total",
+		Help: "Bytes written serving frames over HTTP, labeled by route (\"image\" or \"mjpeg\").",
+	}, []string{"camera", "stream", "route"})
+
+	exposureMicroseconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aravis_exposure_microseconds",
+		Help: "Current exposure time.",
+	}, []string{"camera"})
+
+	gainDecibels = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aravis_gain_decibels",
+		Help: "Current gain.",
+	}, []string{"camera"})
+)
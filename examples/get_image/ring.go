@@ -0,0 +1,374 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ringFrame is one historical raw Gray/Bayer frame, kept long enough to be
+// re-encoded on demand by /snapshot and /clip.
+type ringFrame struct {
+	timestamp time.Time
+	payload   []byte
+}
+
+// frameRing keeps the last `window` worth of frames for a stream. Writes
+// (add) are serialized by mu, but reads (snapshot and everything built on
+// top of it) only ever atomic.Value.Load a frozen slice, so a slow
+// /clip request can't stall the acquisition loop publishing new frames.
+type frameRing struct {
+	window time.Duration
+	mu     sync.Mutex
+	buf    atomic.Value // []ringFrame, oldest first
+}
+
+func newFrameRing(window time.Duration) *frameRing {
+	fr := &frameRing{window: window}
+	fr.buf.Store([]ringFrame{})
+	return fr
+}
+
+// add appends a frame and drops anything older than the window. The caller
+// must not reuse payload's backing array afterward.
+func (fr *frameRing) add(ts time.Time, payload []byte) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	cur := fr.buf.Load().([]ringFrame)
+	cutoff := ts.Add(-fr.window)
+	next := make([]ringFrame, 0, len(cur)+1)
+	for _, f := range cur {
+		if f.timestamp.After(cutoff) {
+			next = append(next, f)
+		}
+	}
+	fr.buf.Store(append(next, ringFrame{timestamp: ts, payload: payload}))
+}
+
+func (fr *frameRing) snapshot() []ringFrame {
+	return fr.buf.Load().([]ringFrame)
+}
+
+// closest returns the buffered frame nearest to at.
+func (fr *frameRing) closest(at time.Time) (ringFrame, bool) {
+	frames := fr.snapshot()
+	if len(frames) == 0 {
+		return ringFrame{}, false
+	}
+	best := frames[0]
+	bestDiff := absDuration(best.timestamp.Sub(at))
+	for _, f := range frames[1:] {
+		if d := absDuration(f.timestamp.Sub(at)); d < bestDiff {
+			best, bestDiff = f, d
+		}
+	}
+	return best, true
+}
+
+func (fr *frameRing) between(from, to time.Time) []ringFrame {
+	frames := fr.snapshot()
+	out := make([]ringFrame, 0, len(frames))
+	for _, f := range frames {
+		if !f.timestamp.Before(from) && !f.timestamp.After(to) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func (f ringFrame) encode(width, height int, enc Encoder, w io.Writer) (string, error) {
+	img := image.NewGray(image.Rectangle{image.Point{0, 0}, image.Point{width, height}})
+	img.Pix = f.payload
+	return enc.Encode(img, w)
+}
+
+// serveSnapshot returns the buffered frame closest to ?at= (RFC3339,
+// defaulting to now), encoded as ?format= (default "png").
+func serveSnapshot(sp *streamPipeline) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sp.ring == nil {
+			http.Error(w, "ring buffer disabled (see -buffer-seconds)", http.StatusNotImplemented)
+			return
+		}
+
+		at := time.Now()
+		if s := r.FormValue("at"); s != "" {
+			parsed, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid at: %v", err), http.StatusBadRequest)
+				return
+			}
+			at = parsed
+		}
+
+		frame, ok := sp.ring.closest(at)
+		if !ok {
+			http.Error(w, "no frames buffered", http.StatusNotFound)
+			return
+		}
+
+		format := r.FormValue("format")
+		if format == "" {
+			format = "png"
+		}
+		enc, err := newEncoder(format, jpegQuality)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var buf bytes.Buffer
+		contentType, err := frame.encode(sp.width, sp.height, enc, &buf)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(buf.Bytes())
+	})
+}
+
+// serveClip downloads every buffered frame between ?from= and ?to=
+// (RFC3339), as a zip of images (?format=zip, the default, one image per
+// frame named by timestamp) or as a one-shot MJPEG playback
+// (?format=mjpeg).
+func serveClip(sp *streamPipeline) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sp.ring == nil {
+			http.Error(w, "ring buffer disabled (see -buffer-seconds)", http.StatusNotImplemented)
+			return
+		}
+
+		from, err := time.Parse(time.RFC3339, r.FormValue("from"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+			return
+		}
+		to, err := time.Parse(time.RFC3339, r.FormValue("to"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid to: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		frames := sp.ring.between(from, to)
+		if len(frames) == 0 {
+			http.Error(w, "no frames buffered in range", http.StatusNotFound)
+			return
+		}
+
+		format := r.FormValue("format")
+		if format == "" {
+			format = "zip"
+		}
+
+		switch format {
+		case "zip":
+			imgFormat := r.FormValue("imgformat")
+			if imgFormat == "" {
+				imgFormat = "png"
+			}
+			enc, err := newEncoder(imgFormat, jpegQuality)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/zip")
+			zw := zip.NewWriter(w)
+			for _, frame := range frames {
+				entry, err := zw.Create(frame.timestamp.UTC().Format("20060102T150405.000000000Z") + "." + imgFormat)
+				if err != nil {
+					return
+				}
+				if _, err := frame.encode(sp.width, sp.height, enc, entry); err != nil {
+					return
+				}
+			}
+			zw.Close()
+
+		case "mjpeg":
+			enc := newJPEGEncoder(jpegQuality)
+			mw := multipart.NewWriter(w)
+			w.Header().Set("Content-Type", fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", mw.Boundary()))
+			for _, frame := range frames {
+				var buf bytes.Buffer
+				if _, err := frame.encode(sp.width, sp.height, enc, &buf); err != nil {
+					return
+				}
+				part, err := mw.CreatePart(textproto.MIMEHeader{
+					"Content-Type":   {"image/jpeg"},
+					"Content-Length": {strconv.Itoa(buf.Len())},
+				})
+				if err != nil {
+					return
+				}
+				if _, err := part.Write(buf.Bytes()); err != nil {
+					return
+				}
+			}
+			mw.Close()
+
+		default:
+			http.Error(w, "unknown format (want zip or mjpeg)", http.StatusBadRequest)
+		}
+	})
+}
+
+// serveTrigger freezes the ring's current contents (pre-roll) immediately,
+// then writes it and the next ?seconds= (defaulting to defaultSeconds) of
+// newly published frames (post-roll) to disk in the background. It
+// responds as soon as the pre-roll snapshot is taken, without waiting for
+// any of it to be encoded or written — with a realistic buffer window that
+// can be thousands of frames, and the response shouldn't be gated on that.
+func serveTrigger(sp *streamPipeline, defaultSeconds float64, dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		if sp.ring == nil {
+			http.Error(w, "ring buffer disabled (see -buffer-seconds)", http.StatusNotImplemented)
+			return
+		}
+
+		seconds := defaultSeconds
+		if s := r.FormValue("seconds"); s != "" {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid seconds: %v", err), http.StatusBadRequest)
+				return
+			}
+			seconds = v
+		}
+
+		triggeredAt := time.Now()
+		outDir := filepath.Join(dir, triggeredAt.UTC().Format("20060102T150405.000Z"))
+
+		// Freeze the buffer's current contents before anything else can run,
+		// so a slow write doesn't let post-roll frames evict pre-roll ones.
+		// The snapshot itself is cheap (an atomic.Value load); encoding and
+		// writing every frame to disk happens in the background so the
+		// response isn't gated on it.
+		preFrames := sp.ring.snapshot()
+		go func() {
+			if _, err := writeFrames(filepath.Join(outDir, "pre"), sp.width, sp.height, preFrames); err != nil {
+				logger.Error("trigger pre-roll failed", "camera", sp.cameraID, "stream", sp.name, "err", err)
+			}
+		}()
+		go capturePostRoll(sp, filepath.Join(outDir, "post"), time.Duration(seconds*float64(time.Second)))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"dir":         outDir,
+			"triggeredAt": triggeredAt.Format(time.RFC3339),
+			"preFrames":   len(preFrames),
+			"postSeconds": seconds,
+		})
+	})
+}
+
+func writeFrames(dir string, width, height int, frames []ringFrame) (int, error) {
+	if len(frames) == 0 {
+		return 0, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+	enc := newPNGEncoder()
+	for _, frame := range frames {
+		f, err := os.Create(filepath.Join(dir, frame.timestamp.UTC().Format("20060102T150405.000000000Z")+".png"))
+		if err != nil {
+			return 0, err
+		}
+		_, err = frame.encode(width, height, enc, f)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(frames), nil
+}
+
+// capturePostRoll writes sp's live PNG frames to dir as they're published,
+// for duration, reusing the same cond/seq wait serveMJPEG uses to wake on
+// new frames instead of polling.
+func capturePostRoll(sp *streamPipeline, dir string, duration time.Duration) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		logger.Error("trigger post-roll failed", "camera", sp.cameraID, "stream", sp.name, "err", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sp.out.mu.Lock()
+			sp.out.cond.Broadcast()
+			sp.out.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	sp.out.mu.Lock()
+	lastSeq := sp.out.seq
+	sp.out.mu.Unlock()
+
+	for {
+		sp.out.mu.Lock()
+		for sp.out.seq == lastSeq && ctx.Err() == nil {
+			sp.out.cond.Wait()
+		}
+		if ctx.Err() != nil {
+			sp.out.mu.Unlock()
+			return
+		}
+		lastSeq = sp.out.seq
+		fb, ok := sp.out.frames["png"]
+		var frame []byte
+		if ok {
+			frame = fb.data
+		}
+		ts := sp.out.lastFrame
+		sp.out.mu.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		f, err := os.Create(filepath.Join(dir, ts.UTC().Format("20060102T150405.000000000Z")+".png"))
+		if err != nil {
+			logger.Error("trigger post-roll failed", "camera", sp.cameraID, "stream", sp.name, "err", err)
+			continue
+		}
+		_, err = f.Write(frame)
+		f.Close()
+		if err != nil {
+			logger.Error("trigger post-roll failed", "camera", sp.cameraID, "stream", sp.name, "err", err)
+		}
+	}
+}